@@ -12,10 +12,20 @@ import (
 
 type Mongodb struct {
 	// config
-	Send_request  bool
-	Send_response bool
-
-	transactionsMap map[common.HashableTcpTuple]*MongodbTransaction
+	Send_request   bool
+	Send_response  bool
+	Compressors    []string // codecs to disable, e.g. ["zstd"]
+	Cursor_ttl     int      // seconds before an untracked (no KILL_CURSORS seen) cursor is forgotten
+	Redact         MongodbRedactConfig
+	Max_doc_length int // bytes a string/binary value is truncated to before publishing
+
+	// transactionsMap holds, per TCP tuple, the FIFO of requests still
+	// awaiting a response. Pipelined requests, exhaust cursors and async
+	// batches can all have several requests outstanding on one connection
+	// at once, so responses are matched to their request by requestId
+	// (via the reply's responseTo) rather than by queue position.
+	transactionsMap map[common.HashableTcpTuple][]*MongodbTransaction
+	cursorRegistry  map[cursorKey]*cursorInfo
 
 	results chan common.MapStr
 }
@@ -32,9 +42,43 @@ func (mongodb *Mongodb) setFromConfig() error {
 	if config.ConfigMeta.IsDefined("protocols", "mongodb", "send_response") {
 		mongodb.Send_response = config.ConfigSingleton.Protocols["mongodb"].Send_response
 	}
+	if config.ConfigMeta.IsDefined("protocols", "mongodb", "compressors") {
+		mongodb.Compressors = config.ConfigSingleton.Protocols["mongodb"].Compressors
+	}
+	for _, name := range mongodb.Compressors {
+		disabledCompressors[name] = true
+	}
+	if config.ConfigMeta.IsDefined("protocols", "mongodb", "cursor_ttl") {
+		mongodb.Cursor_ttl = config.ConfigSingleton.Protocols["mongodb"].Cursor_ttl
+	}
+	if config.ConfigMeta.IsDefined("protocols", "mongodb", "redact", "field_names") {
+		mongodb.Redact.Field_names = config.ConfigSingleton.Protocols["mongodb"].Redact.Field_names
+	}
+	if config.ConfigMeta.IsDefined("protocols", "mongodb", "redact", "commands") {
+		mongodb.Redact.Commands = config.ConfigSingleton.Protocols["mongodb"].Redact.Commands
+	}
+	for _, name := range mongodb.Redact.Field_names {
+		redactFieldNames[name] = true
+	}
+	for _, name := range mongodb.Redact.Commands {
+		redactCommands[name] = true
+	}
+	if config.ConfigMeta.IsDefined("protocols", "mongodb", "max_doc_length") {
+		mongodb.Max_doc_length = config.ConfigSingleton.Protocols["mongodb"].Max_doc_length
+	}
+	if mongodb.Max_doc_length > 0 {
+		maxDocLength = mongodb.Max_doc_length
+	}
 	return nil
 }
 
+func (mongodb *Mongodb) cursorTTL() time.Duration {
+	if mongodb.Cursor_ttl == 0 {
+		return CursorTTLDefault
+	}
+	return time.Duration(mongodb.Cursor_ttl) * time.Second
+}
+
 func (mongodb *Mongodb) Init(test_mode bool, results chan common.MapStr) error {
 	logp.Debug("mongodb", "Init a MongoDB protocol parser")
 
@@ -43,7 +87,8 @@ func (mongodb *Mongodb) Init(test_mode bool, results chan common.MapStr) error {
 		mongodb.setFromConfig()
 	}
 
-	mongodb.transactionsMap = make(map[common.HashableTcpTuple]*MongodbTransaction, TransactionsHashSize)
+	mongodb.transactionsMap = make(map[common.HashableTcpTuple][]*MongodbTransaction, TransactionsHashSize)
+	mongodb.cursorRegistry = make(map[cursorKey]*cursorInfo)
 	mongodb.results = results
 
 	return nil
@@ -134,70 +179,87 @@ func (mongodb *Mongodb) handleMongodb(m *MongodbMessage, tcptuple *common.TcpTup
 }
 
 func (mongodb *Mongodb) receivedMongodbRequest(msg *MongodbMessage) {
-	// Add it to the HT
+	if msg.method == "killCursors" {
+		mongodb.handleKillCursors(msg)
+		return
+	}
+
 	tuple := msg.TcpTuple
 
-	trans := mongodb.transactionsMap[tuple.Hashable()]
-	if trans != nil {
-		if trans.Mongodb != nil {
-			logp.Warn("Two requests without a Response. Dropping old request")
-		}
-	} else {
-		logp.Debug("mongodb", "Initialize new transaction from request")
-		trans = &MongodbTransaction{Type: "mongodb", tuple: tuple}
-		mongodb.transactionsMap[tuple.Hashable()] = trans
+	if msg.method == "getMore" {
+		mongodb.enrichGetMore(msg)
 	}
 
-	trans.Mongodb = common.MapStr{}
+	logp.Debug("mongodb", "Initialize new transaction from request")
+	trans := &MongodbTransaction{Type: "mongodb", tuple: tuple, requestId: msg.requestId}
 
+	trans.Mongodb = common.MapStr{}
 	trans.event = msg.event
-
 	trans.method = msg.method
-
 	trans.cmdline = msg.CmdlineTuple
 	trans.ts = msg.Ts
 	trans.Ts = int64(trans.ts.UnixNano() / 1000) // transactions have microseconds resolution
 	trans.JsTs = msg.Ts
-	trans.Src = common.Endpoint{
-		Ip:   msg.TcpTuple.Src_ip.String(),
-		Port: msg.TcpTuple.Src_port,
-		Proc: string(msg.CmdlineTuple.Src),
-	}
-	trans.Dst = common.Endpoint{
-		Ip:   msg.TcpTuple.Dst_ip.String(),
-		Port: msg.TcpTuple.Dst_port,
-		Proc: string(msg.CmdlineTuple.Dst),
-	}
-	if msg.Direction == tcp.TcpDirectionReverse {
-		trans.Src, trans.Dst = trans.Dst, trans.Src
-	}
+	trans.Src, trans.Dst = endpointsFromMessage(msg)
 
-	if trans.timer != nil {
-		trans.timer.Stop()
-	}
 	trans.timer = time.AfterFunc(TransactionTimeout, func() { mongodb.expireTransaction(trans) })
 
+	mongodb.enqueueTransaction(trans)
+}
+
+// enqueueTransaction appends trans to the FIFO of requests outstanding on
+// its TCP tuple.
+func (mongodb *Mongodb) enqueueTransaction(trans *MongodbTransaction) {
+	key := trans.tuple.Hashable()
+	mongodb.transactionsMap[key] = append(mongodb.transactionsMap[key], trans)
+}
+
+// dequeueTransaction removes and returns the queued transaction on tuple
+// whose requestId matches responseTo, wherever it sits in the FIFO -- a
+// reply doesn't have to answer the oldest outstanding request.
+func (mongodb *Mongodb) dequeueTransaction(tuple common.TcpTuple, responseTo int) *MongodbTransaction {
+	key := tuple.Hashable()
+	queue := mongodb.transactionsMap[key]
+
+	for i, trans := range queue {
+		if trans.requestId == responseTo {
+			mongodb.setTransactionQueue(key, append(queue[:i:i], queue[i+1:]...))
+			return trans
+		}
+	}
+	return nil
+}
+
+func (mongodb *Mongodb) setTransactionQueue(key common.HashableTcpTuple, queue []*MongodbTransaction) {
+	if len(queue) == 0 {
+		delete(mongodb.transactionsMap, key)
+		return
+	}
+	mongodb.transactionsMap[key] = queue
 }
 
 func (mongodb *Mongodb) expireTransaction(trans *MongodbTransaction) {
 	logp.Debug("mongodb", "Expire transaction")
-	// remove from map
-	delete(mongodb.transactionsMap, trans.tuple.Hashable())
+
+	key := trans.tuple.Hashable()
+	queue := mongodb.transactionsMap[key]
+	for i, t := range queue {
+		if t == trans {
+			mongodb.setTransactionQueue(key, append(queue[:i:i], queue[i+1:]...))
+			break
+		}
+	}
 }
 
 func (mongodb *Mongodb) receivedMongodbResponse(msg *MongodbMessage) {
 
-	tuple := msg.TcpTuple
-	trans := mongodb.transactionsMap[tuple.Hashable()]
+	trans := mongodb.dequeueTransaction(msg.TcpTuple, msg.responseTo)
 	if trans == nil {
-		logp.Warn("Response from unknown transaction. Ignoring.")
+		logp.Warn("Response from unknown transaction (responseTo=%d). Ignoring.", msg.responseTo)
 		return
 	}
-	// check if the request was received
-	if trans.Mongodb == nil {
-		logp.Warn("Response from unknown transaction. Ignoring.")
-		return
-
+	if trans.timer != nil {
+		trans.timer.Stop()
 	}
 
 	// Merge request and response events attributes
@@ -205,6 +267,8 @@ func (mongodb *Mongodb) receivedMongodbResponse(msg *MongodbMessage) {
 		trans.event[k] = v
 	}
 
+	mongodb.maybeRegisterCursor(trans, msg)
+
 	trans.error = msg.error
 
 	trans.ResponseTime = int32(msg.Ts.Sub(trans.ts).Nanoseconds() / 1e6) // resp_time in milliseconds
@@ -213,25 +277,242 @@ func (mongodb *Mongodb) receivedMongodbResponse(msg *MongodbMessage) {
 
 	logp.Debug("mongodb", "Mongodb transaction completed: %s", trans.Mongodb)
 
-	// remove from map
-	delete(mongodb.transactionsMap, trans.tuple.Hashable())
-	if trans.timer != nil {
-		trans.timer.Stop()
+	if msg.moreToCome {
+		// an OP_MSG exhaust cursor or multi-reply exchange: more responses
+		// are still expected for this requestId, keep the transaction
+		// queued and let its timer keep watching for the final one.
+		trans.timer = time.AfterFunc(TransactionTimeout, func() { mongodb.expireTransaction(trans) })
+		mongodb.enqueueTransaction(trans)
 	}
 }
 
-func (mongodb *Mongodb) GapInStream(tcptuple *common.TcpTuple, dir uint8,
-	private protos.ProtocolData) protos.ProtocolData {
+// maybeRegisterCursor starts tracking a server-side cursor the first time a
+// reply for it comes back with a non-zero cursorId, whether that's a legacy
+// OP_REPLY's top-level cursorId or an OP_MSG find/aggregate/getMore reply's
+// cursor.id (both are normalized onto msg.event["cursorId"] by their
+// respective parsers). Subsequent replies for the same cursor (answering a
+// getMore) leave the existing entry, and its round trip count, untouched.
+func (mongodb *Mongodb) maybeRegisterCursor(trans *MongodbTransaction, msg *MongodbMessage) {
+	cursorId, ok := msg.event["cursorId"].(int64)
+	if !ok || cursorId == 0 {
+		return
+	}
 
-	// TODO
+	key := cursorKey{tuple: trans.tuple.Hashable(), cursorId: cursorId}
+	if _, exists := mongodb.cursorRegistry[key]; exists {
+		return
+	}
 
-	return private
+	collection, _ := trans.event["fullCollectionName"].(string)
+	query, _ := trans.event["query"].(common.MapStr)
+
+	cursor := &cursorInfo{
+		collection: collection,
+		query:      query,
+		start:      msg.Ts,
+	}
+	cursor.timer = time.AfterFunc(mongodb.cursorTTL(), func() { mongodb.evictCursor(key) })
+	mongodb.cursorRegistry[key] = cursor
+
+	logp.Debug("mongodb", "Tracking new cursor %d on %s", cursorId, collection)
+}
+
+// enrichGetMore adds cursor.* fields to a getMore request's event (legacy
+// OP_GET_MORE or its OP_MSG command equivalent), describing the cursor it
+// is paging through, when that cursor was opened by a query packetbeat has
+// seen.
+func (mongodb *Mongodb) enrichGetMore(msg *MongodbMessage) {
+	cursorId, ok := msg.event["cursorId"].(int64)
+	if !ok || cursorId == 0 {
+		return
+	}
+
+	key := cursorKey{tuple: msg.TcpTuple.Hashable(), cursorId: cursorId}
+	cursor, found := mongodb.cursorRegistry[key]
+	if !found {
+		return
+	}
+
+	cursor.roundTrips++
+	msg.event["cursor.id"] = cursorId
+	msg.event["cursor.origin_query"] = cursor.query
+	msg.event["cursor.round_trip"] = cursor.roundTrips
+	msg.event["cursor.age_ms"] = msg.Ts.Sub(cursor.start).Nanoseconds() / 1e6
+}
+
+// handleKillCursors evicts every tracked cursor a killCursors request names
+// (legacy OP_KILL_CURSORS or its OP_MSG command equivalent) and publishes a
+// synthetic "cursor_closed" event for each, carrying the same origin fields
+// a regular cursor.* enriched event would. This bypasses the usual
+// request/response transaction matching entirely, since OP_KILL_CURSORS
+// itself gets no reply.
+func (mongodb *Mongodb) handleKillCursors(msg *MongodbMessage) {
+	ids, _ := msg.event["cursorIds"].([]int64)
+
+	for _, cursorId := range ids {
+		key := cursorKey{tuple: msg.TcpTuple.Hashable(), cursorId: cursorId}
+		cursor, found := mongodb.cursorRegistry[key]
+		if !found {
+			continue
+		}
+
+		if cursor.timer != nil {
+			cursor.timer.Stop()
+		}
+		delete(mongodb.cursorRegistry, key)
+
+		mongodb.publishCursorClosed(msg, cursorId, cursor)
+	}
 }
 
+func (mongodb *Mongodb) evictCursor(key cursorKey) {
+	logp.Debug("mongodb", "Evicting stale cursor %d after cursor_ttl", key.cursorId)
+	delete(mongodb.cursorRegistry, key)
+}
+
+func (mongodb *Mongodb) publishCursorClosed(msg *MongodbMessage, cursorId int64, cursor *cursorInfo) {
+	if mongodb.results == nil {
+		return
+	}
+
+	src, dst := endpointsFromMessage(msg)
+
+	event := common.MapStr{}
+	event["type"] = "mongodb"
+	event["status"] = common.OK_STATUS
+	event["method"] = "cursor_closed"
+	event["mongodb"] = common.MapStr{
+		"fullCollectionName":  cursor.collection,
+		"cursor.id":           cursorId,
+		"cursor.origin_query": cursor.query,
+		"cursor.round_trip":   cursor.roundTrips,
+		"cursor.age_ms":       msg.Ts.Sub(cursor.start).Nanoseconds() / 1e6,
+	}
+	event["@timestamp"] = common.Time(msg.Ts)
+	event["src"] = &src
+	event["dst"] = &dst
+
+	mongodb.results <- event
+}
+
+// endpointsFromMessage builds the src/dst endpoints packetbeat publishes
+// with every mongodb event, direction-corrected the same way transactions
+// are in receivedMongodbRequest.
+func endpointsFromMessage(msg *MongodbMessage) (common.Endpoint, common.Endpoint) {
+	src := common.Endpoint{
+		Ip:   msg.TcpTuple.Src_ip.String(),
+		Port: msg.TcpTuple.Src_port,
+		Proc: string(msg.CmdlineTuple.Src),
+	}
+	dst := common.Endpoint{
+		Ip:   msg.TcpTuple.Dst_ip.String(),
+		Port: msg.TcpTuple.Dst_port,
+		Proc: string(msg.CmdlineTuple.Dst),
+	}
+	if msg.Direction == tcp.TcpDirectionReverse {
+		src, dst = dst, src
+	}
+	return src, dst
+}
+
+// GapInStream is called when a gap (packet loss) was detected in the TCP
+// stream. A half-parsed MongodbStream points at a byte offset into
+// stream.data that, after the gap, no longer lines up with the reassembled
+// buffer, so we either resync onto the next message or give up on the
+// stream entirely rather than let the parser feed on garbage.
+func (mongodb *Mongodb) GapInStream(tcptuple *common.TcpTuple, dir uint8, nbytes int,
+	private protos.ProtocolData) (protos.ProtocolData, bool) {
+
+	priv, ok := private.(mongodbPrivateData)
+	if !ok {
+		return private, false
+	}
+
+	stream := priv.Data[dir]
+	if stream == nil || stream.message == nil {
+		// no message in flight on this side, nothing to recover
+		return priv, false
+	}
+
+	msg := stream.message
+	if msg.messageLength == 0 {
+		// the gap falls inside the 16 byte standard header itself: we
+		// don't even know how long the message is supposed to be, so
+		// there's nothing sane to resync to. Drop the stream and let the
+		// next segment start fresh.
+		priv.Data[dir] = nil
+		return priv, true
+	}
+
+	// The gap falls inside the still-unread body of a message whose
+	// messageLength was already read from the header: skip over it,
+	// publish what we have so far marked partial, and reset the stream so
+	// the next segment is parsed as a new message.
+	logp.Debug("mongodb", "Gap of %d bytes in mongodb stream, %s message truncated", nbytes, msg.opCode)
+
+	if msg.event == nil {
+		msg.event = common.MapStr{}
+	}
+	msg.event["partial"] = true
+	msg.IsResponse = msg.responseTo != 0
+	msg.TcpTuple = *tcptuple
+	msg.Direction = dir
+	msg.CmdlineTuple = procs.ProcWatcher.FindProcessesTuple(tcptuple.IpPort())
+
+	if msg.IsResponse {
+		// handleMongodb's normal response path dequeues the matching
+		// request transaction by responseTo and publishes it, so reusing
+		// it here still publishes even though the reply is partial.
+		mongodb.handleMongodb(msg, tcptuple, dir)
+	} else {
+		// Feeding this through receivedMongodbRequest would only enqueue
+		// it to wait for a response -- and since the same packet loss
+		// that truncated this request commonly means no response ever
+		// arrives either, expireTransaction would eventually drop it with
+		// no publish at all. Publish the partial request directly instead
+		// of gambling on a future reply.
+		mongodb.publishPartialRequest(msg)
+	}
+
+	priv.Data[dir] = nil
+
+	return priv, false
+}
+
+// publishPartialRequest builds and publishes a transaction straight from a
+// request-direction message that GapInStream truncated, instead of queueing
+// it to await a response that packet loss may mean never arrives.
+func (mongodb *Mongodb) publishPartialRequest(msg *MongodbMessage) {
+	trans := &MongodbTransaction{Type: "mongodb", tuple: msg.TcpTuple, requestId: msg.requestId}
+
+	trans.Mongodb = common.MapStr{}
+	trans.event = msg.event
+	trans.method = msg.method
+	trans.cmdline = msg.CmdlineTuple
+	trans.ts = msg.Ts
+	trans.Ts = int64(trans.ts.UnixNano() / 1000)
+	trans.JsTs = msg.Ts
+	trans.Src, trans.Dst = endpointsFromMessage(msg)
+	trans.error = msg.error
+
+	mongodb.publishTransaction(trans)
+}
+
+// ReceivedFin flushes any transaction still waiting for a response on
+// tuple's queue instead of leaking its timer until TransactionTimeout.
 func (mongodb *Mongodb) ReceivedFin(tcptuple *common.TcpTuple, dir uint8,
 	private protos.ProtocolData) protos.ProtocolData {
 
-	// TODO
+	key := tcptuple.Hashable()
+	for _, trans := range mongodb.transactionsMap[key] {
+		if trans.timer != nil {
+			trans.timer.Stop()
+		}
+		trans.event["fin_before_response"] = true
+		mongodb.publishTransaction(trans)
+	}
+	delete(mongodb.transactionsMap, key)
+
 	return private
 }
 
@@ -0,0 +1,99 @@
+package mongodb
+
+import (
+	"errors"
+	"fmt"
+
+	"packetbeat/common"
+
+	"labix.org/v2/mgo/bson"
+)
+
+var errTooShort = errors.New("mongodb: truncated BSON document")
+var errUnsupportedCompressor = errors.New("mongodb: unsupported or disabled OP_COMPRESSED compressor")
+
+const redactedValue = "***"
+
+const MaxDocLengthDefault = 10 * 1024
+
+// redactFieldNames holds the BSON keys (protocols.mongodb.redact.field_names)
+// whose values are replaced with redactedValue regardless of how deeply
+// they're nested in a document.
+var redactFieldNames = map[string]bool{}
+
+// redactCommands holds command names (protocols.mongodb.redact.commands)
+// whose entire argument document is dropped rather than published, e.g.
+// createUser/authenticate payloads carrying passwords.
+var redactCommands = map[string]bool{}
+
+// maxDocLength is protocols.mongodb.max_doc_length: string and binary
+// values longer than this are truncated before publishing.
+var maxDocLength = MaxDocLengthDefault
+
+// bson2dict recursively converts a decoded BSON document into a
+// common.MapStr so it can be attached to a transaction event and published,
+// applying field-name redaction and value truncation along the way.
+func bson2dict(doc bson.M) common.MapStr {
+	dict := common.MapStr{}
+	for k, v := range doc {
+		if redactFieldNames[k] {
+			dict[k] = redactedValue
+			continue
+		}
+		dict[k] = bson2value(v)
+	}
+	return dict
+}
+
+func bson2value(v interface{}) interface{} {
+	switch val := v.(type) {
+	case bson.M:
+		return bson2dict(val)
+	case bson.D:
+		return bson2dict(bsonDToM(val))
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, elem := range val {
+			out[i] = bson2value(elem)
+		}
+		return out
+	case string:
+		return truncateString(val)
+	case []byte:
+		return truncateBinary(val)
+	default:
+		return v
+	}
+}
+
+// redactCommandArgs drops dict entirely when method is configured for
+// redaction (protocols.mongodb.redact.commands), so things like a
+// createUser's pwd field never reach MongodbTransaction.event even nested
+// under a key that wasn't explicitly listed in redact.field_names.
+func redactCommandArgs(method string, dict common.MapStr) common.MapStr {
+	if redactCommands[method] {
+		return common.MapStr{"redacted": redactedValue}
+	}
+	return dict
+}
+
+func truncateString(s string) interface{} {
+	if len(s) <= maxDocLength {
+		return s
+	}
+	truncated := len(s) - maxDocLength
+	return fmt.Sprintf("%s...[truncated %d bytes]", s[:maxDocLength], truncated)
+}
+
+// truncateBinary keeps the result a []byte in both branches: the field must
+// not change Go type depending on document size, and slicing binary data
+// through a string (as truncateString does for text) would corrupt
+// non-UTF-8 bytes.
+func truncateBinary(b []byte) interface{} {
+	if len(b) <= maxDocLength {
+		return b
+	}
+	truncated := len(b) - maxDocLength
+	suffix := fmt.Sprintf("...[truncated %d bytes]", truncated)
+	return append(b[:maxDocLength:maxDocLength], []byte(suffix)...)
+}
@@ -0,0 +1,91 @@
+package mongodb
+
+import (
+	"bytes"
+	"testing"
+
+	"packetbeat/common"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func TestBson2DictRedactsFieldNamesRecursively(t *testing.T) {
+	old := redactFieldNames
+	redactFieldNames = map[string]bool{"pwd": true}
+	defer func() { redactFieldNames = old }()
+
+	doc := bson.M{
+		"user": "alice",
+		"pwd":  "secret",
+		"nested": bson.M{
+			"pwd": "secret2",
+		},
+	}
+
+	dict := bson2dict(doc)
+	if dict["pwd"] != redactedValue {
+		t.Errorf("expected top-level pwd to be redacted, got %v", dict["pwd"])
+	}
+	if dict["user"] != "alice" {
+		t.Errorf("expected user to be left alone, got %v", dict["user"])
+	}
+	nested, ok := dict["nested"].(common.MapStr)
+	if !ok || nested["pwd"] != redactedValue {
+		t.Errorf("expected nested pwd to be redacted too, got %#v", dict["nested"])
+	}
+}
+
+func TestRedactCommandArgsDropsConfiguredCommandEntirely(t *testing.T) {
+	old := redactCommands
+	redactCommands = map[string]bool{"createUser": true}
+	defer func() { redactCommands = old }()
+
+	dict := common.MapStr{"createUser": "alice", "pwd": "secret"}
+
+	redacted := redactCommandArgs("createUser", dict)
+	if len(redacted) != 1 || redacted["redacted"] != redactedValue {
+		t.Errorf("expected createUser args to be entirely replaced, got %#v", redacted)
+	}
+
+	untouched := redactCommandArgs("find", dict)
+	if untouched["pwd"] != "secret" {
+		t.Errorf("expected an unconfigured command's args to pass through untouched, got %#v", untouched)
+	}
+}
+
+func TestTruncateStringTruncatesOnlyWhenOverLimit(t *testing.T) {
+	old := maxDocLength
+	maxDocLength = 5
+	defer func() { maxDocLength = old }()
+
+	if got := truncateString("hi"); got != "hi" {
+		t.Errorf("expected a short string to pass through unchanged, got %v", got)
+	}
+
+	got, ok := truncateString("hello world").(string)
+	if !ok {
+		t.Fatalf("expected truncated string to still be a string, got %T", got)
+	}
+	if got != "hello...[truncated 6 bytes]" {
+		t.Errorf("unexpected truncated value: %q", got)
+	}
+}
+
+func TestTruncateBinaryStaysByteSliceInBothBranches(t *testing.T) {
+	old := maxDocLength
+	maxDocLength = 5
+	defer func() { maxDocLength = old }()
+
+	short, ok := truncateBinary([]byte{1, 2}).([]byte)
+	if !ok {
+		t.Fatalf("expected a short binary value to stay a []byte, got %T", short)
+	}
+
+	long, ok := truncateBinary([]byte{0xff, 0xfe, 0xfd, 0xfc, 0xfb, 0xfa, 0xf9}).([]byte)
+	if !ok {
+		t.Fatalf("expected a truncated binary value to still be a []byte, got %T", long)
+	}
+	if !bytes.HasPrefix(long, []byte{0xff, 0xfe, 0xfd, 0xfc, 0xfb}) {
+		t.Errorf("expected the truncated value to keep the original leading bytes, got %#v", long)
+	}
+}
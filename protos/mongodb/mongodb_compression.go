@@ -0,0 +1,158 @@
+package mongodb
+
+// Decompression of OP_COMPRESSED (opcode 2012) envelopes.
+// see https://docs.mongodb.com/manual/reference/mongodb-wire-protocol/#op-compressed
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"packetbeat/logp"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	compressorNoop   = 0
+	compressorSnappy = 1
+	compressorZlib   = 2
+	compressorZstd   = 3
+)
+
+// maxUncompressedSize is both the bound checked against the uncompressedSize
+// field an OP_COMPRESSED envelope declares, and the hard ceiling enforced on
+// what decompression actually produces (see readLimited) -- the declared
+// size is just as attacker-controlled as the compressed bytes themselves, so
+// validating the header alone isn't enough to stop a decompression bomb.
+// MongoDB caps a single wire protocol message at 48MB (16MB max BSON
+// document plus overhead); allow some headroom above that.
+const maxUncompressedSize = 64 * 1024 * 1024
+
+// errDecompressionTooLarge is returned when a codec actually produces more
+// than maxUncompressedSize bytes, regardless of what uncompressedSize it
+// declared. A compressed stream's real output length is whatever its own
+// internal length fields say, not the header's hint, so a hostile payload
+// can under-declare uncompressedSize and still decompress to gigabytes --
+// this is the hard ceiling that stops that decompression bomb.
+var errDecompressionTooLarge = errors.New("mongodb: decompressed OP_COMPRESSED payload exceeds size limit")
+
+var compressorNames = map[uint8]string{
+	compressorNoop:   "noop",
+	compressorSnappy: "snappy",
+	compressorZlib:   "zlib",
+	compressorZstd:   "zstd",
+}
+
+// disabledCompressors is populated from protocols.mongodb.compressors and
+// lets an operator turn a codec off (e.g. to keep an unmaintained one out
+// of the parsing path) without changing the wire protocol itself.
+var disabledCompressors = map[string]bool{}
+
+// zstdDecoder is shared across streams: it holds no per-stream state and
+// constructing one is too expensive to do per message.
+var zstdDecoder *zstd.Decoder
+
+func init() {
+	var err error
+	zstdDecoder, err = zstd.NewReader(nil)
+	if err != nil {
+		logp.Warn("mongodb: failed to initialize zstd decoder: %v", err)
+	}
+}
+
+// parseOpCompressed unwraps an OP_COMPRESSED envelope and re-dispatches the
+// decompressed payload as its originalOpcode, as if it had arrived
+// uncompressed.
+func parseOpCompressed(m *MongodbMessage, data []byte) error {
+	originalOpcode, off, err := readInt32(data, 0)
+	if err != nil {
+		return err
+	}
+	uncompressedSize, off, err := readInt32(data, off)
+	if err != nil {
+		return err
+	}
+	if off+1 > len(data) {
+		return errTooShort
+	}
+	compressorId := data[off]
+	off++
+
+	if uncompressedSize < 0 || uncompressedSize > maxUncompressedSize {
+		logp.Warn("mongodb: OP_COMPRESSED declares implausible uncompressed size %d, dropping stream", uncompressedSize)
+		return errUnsupportedCompressor
+	}
+
+	name, known := compressorNames[compressorId]
+	if !known {
+		logp.Debug("mongodb", "Unknown OP_COMPRESSED compressor id %d", compressorId)
+		return errUnsupportedCompressor
+	}
+	if disabledCompressors[name] {
+		logp.Warn("mongodb: %s compression disabled by configuration, dropping stream", name)
+		return errUnsupportedCompressor
+	}
+
+	body, err := decompress(name, data[off:])
+	if err != nil {
+		logp.Warn("mongodb: failed to decompress OP_COMPRESSED payload (%s): %v", name, err)
+		return err
+	}
+
+	opName, known := OpCodes[int(originalOpcode)]
+	if !known {
+		logp.Debug("mongodb", "OP_COMPRESSED wraps unknown opcode %d", originalOpcode)
+		return errUnsupportedCompressor
+	}
+
+	return dispatchMessage(m, opName, body)
+}
+
+func decompress(name string, data []byte) ([]byte, error) {
+	switch name {
+	case "noop":
+		if len(data) > maxUncompressedSize {
+			return nil, errDecompressionTooLarge
+		}
+		return data, nil
+	case "snappy":
+		return readLimited(snappy.NewReader(bytes.NewReader(data)))
+	case "zlib":
+		r, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return readLimited(r)
+	case "zstd":
+		if zstdDecoder == nil {
+			return nil, errUnsupportedCompressor
+		}
+		if err := zstdDecoder.Reset(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+		return readLimited(zstdDecoder)
+	default:
+		return nil, errUnsupportedCompressor
+	}
+}
+
+// readLimited drains r, failing once more than maxUncompressedSize bytes
+// have come out -- the hard ceiling enforced here, regardless of what the
+// OP_COMPRESSED header declared or what length fields the compressed stream
+// itself carries, since both are just as attacker-controlled.
+func readLimited(r io.Reader) ([]byte, error) {
+	lr := &io.LimitedReader{R: r, N: int64(maxUncompressedSize) + 1}
+	body, err := ioutil.ReadAll(lr)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxUncompressedSize {
+		return nil, errDecompressionTooLarge
+	}
+	return body, nil
+}
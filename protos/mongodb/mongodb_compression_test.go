@@ -0,0 +1,112 @@
+package mongodb
+
+import (
+	"bytes"
+	"compress/zlib"
+	"testing"
+
+	"packetbeat/common"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func TestParseOpCompressedNoopWellFormed(t *testing.T) {
+	var inner bytes.Buffer
+	putInt32(&inner, 0) // flags
+	putCString(&inner, "test.coll")
+	putInt32(&inner, 0) // numberToSkip
+	putInt32(&inner, 0) // numberToReturn
+	inner.Write(marshalDoc(t, bson.D{{Name: "count", Value: "coll"}}))
+
+	var buf bytes.Buffer
+	putInt32(&buf, 2004) // originalOpcode: OP_QUERY
+	putInt32(&buf, int32(inner.Len()))
+	buf.WriteByte(compressorNoop)
+	buf.Write(inner.Bytes())
+
+	m := &MongodbMessage{event: common.MapStr{}}
+	if err := parseOpCompressed(m, buf.Bytes()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m.method != "count" {
+		t.Errorf("expected method %q, got %q", "count", m.method)
+	}
+}
+
+func TestParseOpCompressedTruncatedEnvelope(t *testing.T) {
+	// only enough bytes for originalOpcode, not uncompressedSize or compressorId
+	var buf bytes.Buffer
+	putInt32(&buf, 2004)
+
+	m := &MongodbMessage{event: common.MapStr{}}
+	if err := parseOpCompressed(m, buf.Bytes()); err == nil {
+		t.Fatal("expected an error parsing a truncated OP_COMPRESSED envelope, got nil")
+	}
+}
+
+func TestParseOpCompressedImplausibleUncompressedSizeRejected(t *testing.T) {
+	var buf bytes.Buffer
+	putInt32(&buf, 2004)
+	putInt32(&buf, maxUncompressedSize+1)
+	buf.WriteByte(compressorNoop)
+	buf.WriteString("x")
+
+	m := &MongodbMessage{event: common.MapStr{}}
+	if err := parseOpCompressed(m, buf.Bytes()); err == nil {
+		t.Fatal("expected an error for an implausible declared uncompressed size, got nil")
+	}
+}
+
+// TestReadLimitedEnforcesHardCeiling exercises readLimited directly against
+// a reader that never hits EOF, standing in for a decompressor whose actual
+// output (driven by length fields inside the compressed stream itself, not
+// by what the OP_COMPRESSED header declared) runs past maxUncompressedSize.
+func TestReadLimitedEnforcesHardCeiling(t *testing.T) {
+	if _, err := readLimited(zeroReader{}); err != errDecompressionTooLarge {
+		t.Fatalf("expected errDecompressionTooLarge, got %v", err)
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// TestParseOpCompressedZlibBombRejectedDespiteSmallDeclaredSize builds a
+// zlib stream that, regardless of the (deliberately understated)
+// uncompressedSize the envelope declares, actually inflates past
+// maxUncompressedSize -- zlib.NewReader's underlying ioutil.ReadAll has no
+// concept of the header's hint, so only the hard ceiling in readLimited
+// catches this.
+func TestParseOpCompressedZlibBombRejectedDespiteSmallDeclaredSize(t *testing.T) {
+	var compressed bytes.Buffer
+	w := zlib.NewWriter(&compressed)
+	chunk := make([]byte, 1<<16)
+	for remaining := maxUncompressedSize + 1<<20; remaining > 0; remaining -= len(chunk) {
+		n := len(chunk)
+		if remaining < n {
+			n = remaining
+		}
+		if _, err := w.Write(chunk[:n]); err != nil {
+			t.Fatalf("failed to build test zlib stream: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close test zlib stream: %v", err)
+	}
+
+	var buf bytes.Buffer
+	putInt32(&buf, 2004) // originalOpcode: OP_QUERY
+	putInt32(&buf, 10)   // uncompressedSize: lies, declares far less than the stream holds
+	buf.WriteByte(compressorZlib)
+	buf.Write(compressed.Bytes())
+
+	m := &MongodbMessage{event: common.MapStr{}}
+	if err := parseOpCompressed(m, buf.Bytes()); err != errDecompressionTooLarge {
+		t.Fatalf("expected errDecompressionTooLarge, got %v", err)
+	}
+}
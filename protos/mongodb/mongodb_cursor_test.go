@@ -0,0 +1,115 @@
+package mongodb
+
+import (
+	"testing"
+	"time"
+
+	"packetbeat/common"
+)
+
+func newTestMongodb(t *testing.T) (*Mongodb, chan common.MapStr) {
+	mongodb := &Mongodb{}
+	results := make(chan common.MapStr, 10)
+	if err := mongodb.Init(true, results); err != nil {
+		t.Fatalf("failed to init Mongodb: %v", err)
+	}
+	return mongodb, results
+}
+
+func TestMaybeRegisterCursorTracksNewCursor(t *testing.T) {
+	mongodb, _ := newTestMongodb(t)
+	tuple := testTcpTuple(1)
+
+	trans := &MongodbTransaction{
+		tuple: *tuple,
+		event: common.MapStr{"fullCollectionName": "test.coll"},
+	}
+	msg := &MongodbMessage{
+		TcpTuple: *tuple,
+		Ts:       time.Unix(0, 0),
+		event:    common.MapStr{"cursorId": int64(42)},
+	}
+
+	mongodb.maybeRegisterCursor(trans, msg)
+
+	key := cursorKey{tuple: tuple.Hashable(), cursorId: 42}
+	cursor, found := mongodb.cursorRegistry[key]
+	if !found {
+		t.Fatal("expected cursor 42 to be tracked")
+	}
+	if cursor.collection != "test.coll" {
+		t.Errorf("expected collection %q, got %q", "test.coll", cursor.collection)
+	}
+}
+
+func TestMaybeRegisterCursorIgnoresZeroCursorId(t *testing.T) {
+	mongodb, _ := newTestMongodb(t)
+	tuple := testTcpTuple(2)
+
+	trans := &MongodbTransaction{tuple: *tuple, event: common.MapStr{}}
+	msg := &MongodbMessage{TcpTuple: *tuple, Ts: time.Unix(0, 0), event: common.MapStr{"cursorId": int64(0)}}
+
+	mongodb.maybeRegisterCursor(trans, msg)
+
+	if len(mongodb.cursorRegistry) != 0 {
+		t.Errorf("expected no cursor to be tracked for cursorId 0, registry has %d entries", len(mongodb.cursorRegistry))
+	}
+}
+
+func TestEnrichGetMoreAddsCursorFieldsAndCountsRoundTrips(t *testing.T) {
+	mongodb, _ := newTestMongodb(t)
+	tuple := testTcpTuple(3)
+
+	key := cursorKey{tuple: tuple.Hashable(), cursorId: 99}
+	mongodb.cursorRegistry[key] = &cursorInfo{
+		collection: "test.coll",
+		query:      common.MapStr{"find": "coll"},
+		start:      time.Unix(0, 0),
+	}
+
+	msg := &MongodbMessage{TcpTuple: *tuple, Ts: time.Unix(1, 0), event: common.MapStr{"cursorId": int64(99)}}
+	mongodb.enrichGetMore(msg)
+	if msg.event["cursor.round_trip"] != 1 {
+		t.Errorf("expected cursor.round_trip 1, got %v", msg.event["cursor.round_trip"])
+	}
+
+	msg2 := &MongodbMessage{TcpTuple: *tuple, Ts: time.Unix(2, 0), event: common.MapStr{"cursorId": int64(99)}}
+	mongodb.enrichGetMore(msg2)
+	if msg2.event["cursor.round_trip"] != 2 {
+		t.Errorf("expected cursor.round_trip 2 on second getMore, got %v", msg2.event["cursor.round_trip"])
+	}
+}
+
+func TestHandleKillCursorsEvictsAndPublishesCursorClosed(t *testing.T) {
+	mongodb, results := newTestMongodb(t)
+	tuple := testTcpTuple(4)
+
+	key := cursorKey{tuple: tuple.Hashable(), cursorId: 55}
+	mongodb.cursorRegistry[key] = &cursorInfo{
+		collection: "test.coll",
+		query:      common.MapStr{},
+		start:      time.Unix(0, 0),
+		timer:      time.NewTimer(time.Hour),
+	}
+
+	msg := &MongodbMessage{
+		TcpTuple:     *tuple,
+		Ts:           time.Unix(1, 0),
+		CmdlineTuple: testCmdlineTuple(),
+		event:        common.MapStr{"cursorIds": []int64{55}},
+	}
+	mongodb.handleKillCursors(msg)
+
+	if _, found := mongodb.cursorRegistry[key]; found {
+		t.Error("expected cursor 55 to be evicted from the registry")
+	}
+
+	select {
+	case event := <-results:
+		if event["method"] != "cursor_closed" {
+			t.Errorf("expected method %q, got %v", "cursor_closed", event["method"])
+		}
+	default:
+		t.Fatal("expected a cursor_closed event to be published")
+	}
+}
@@ -0,0 +1,123 @@
+package mongodb
+
+import (
+	"testing"
+	"time"
+
+	"packetbeat/common"
+)
+
+func TestGapInStreamDropsStreamWhenHeaderItselfIsTruncated(t *testing.T) {
+	mongodb, _ := newTestMongodb(t)
+	tuple := testTcpTuple(20)
+
+	priv := mongodbPrivateData{}
+	priv.Data[0] = &MongodbStream{tcptuple: tuple, message: &MongodbMessage{}}
+
+	result, drop := mongodb.GapInStream(tuple, 0, 5, priv)
+	if !drop {
+		t.Error("expected a gap inside the standard header to drop the stream")
+	}
+	if result.(mongodbPrivateData).Data[0] != nil {
+		t.Error("expected the stream's per-direction state to be reset")
+	}
+}
+
+func TestGapInStreamPublishesPartialRequestDirectly(t *testing.T) {
+	mongodb, results := newTestMongodb(t)
+	tuple := testTcpTuple(21)
+
+	msg := &MongodbMessage{
+		messageLength: 64,
+		responseTo:    0, // a request, not a reply
+		method:        "insert",
+		CmdlineTuple:  testCmdlineTuple(),
+		Ts:            time.Unix(1, 0),
+		event:         common.MapStr{"fullCollectionName": "test.coll"},
+	}
+	priv := mongodbPrivateData{}
+	priv.Data[0] = &MongodbStream{tcptuple: tuple, message: msg}
+
+	_, drop := mongodb.GapInStream(tuple, 0, 10, priv)
+	if drop {
+		t.Error("expected the TCP stream itself to stay up after a mid-message gap")
+	}
+
+	select {
+	case event := <-results:
+		if event["method"] != "insert" {
+			t.Errorf("expected method %q, got %v", "insert", event["method"])
+		}
+		mongodbFields, ok := event["mongodb"].(common.MapStr)
+		if !ok || mongodbFields["partial"] != true {
+			t.Errorf("expected mongodb.partial=true, got %#v", event["mongodb"])
+		}
+	default:
+		t.Fatal("expected the partial request to be published directly instead of waiting for a response that packet loss may have also dropped")
+	}
+}
+
+func TestGapInStreamOnResponseDequeuesMatchingRequest(t *testing.T) {
+	mongodb, results := newTestMongodb(t)
+	tuple := testTcpTuple(22)
+
+	trans := &MongodbTransaction{
+		tuple:     *tuple,
+		requestId: 5,
+		event:     common.MapStr{},
+		ts:        time.Unix(1, 0),
+	}
+	mongodb.enqueueTransaction(trans)
+
+	msg := &MongodbMessage{
+		messageLength: 64,
+		responseTo:    5,
+		CmdlineTuple:  testCmdlineTuple(),
+		Ts:            time.Unix(1, 200000000),
+		event:         common.MapStr{},
+	}
+	priv := mongodbPrivateData{}
+	priv.Data[0] = &MongodbStream{tcptuple: tuple, message: msg}
+
+	mongodb.GapInStream(tuple, 0, 10, priv)
+
+	select {
+	case <-results:
+	default:
+		t.Fatal("expected the matching request's transaction to be published")
+	}
+	if len(mongodb.transactionsMap) != 0 {
+		t.Errorf("expected the matched transaction to be removed from the queue, got %#v", mongodb.transactionsMap)
+	}
+}
+
+func TestReceivedFinFlushesAllQueuedTransactions(t *testing.T) {
+	mongodb, results := newTestMongodb(t)
+	tuple := testTcpTuple(23)
+
+	first := &MongodbTransaction{tuple: *tuple, requestId: 1, event: common.MapStr{}, ts: time.Unix(1, 0)}
+	second := &MongodbTransaction{tuple: *tuple, requestId: 2, event: common.MapStr{}, ts: time.Unix(2, 0)}
+	mongodb.enqueueTransaction(first)
+	mongodb.enqueueTransaction(second)
+
+	mongodb.ReceivedFin(tuple, 0, nil)
+
+	published := 0
+	for i := 0; i < 2; i++ {
+		select {
+		case event := <-results:
+			mongodbFields, ok := event["mongodb"].(common.MapStr)
+			if !ok || mongodbFields["fin_before_response"] != true {
+				t.Errorf("expected fin_before_response=true, got %#v", event["mongodb"])
+			}
+			published++
+		default:
+		}
+	}
+	if published != 2 {
+		t.Fatalf("expected both queued transactions to be flushed, got %d", published)
+	}
+	if _, exists := mongodb.transactionsMap[tuple.Hashable()]; exists {
+		t.Error("expected the tuple's queue to be removed after ReceivedFin")
+	}
+}
@@ -0,0 +1,280 @@
+package mongodb
+
+// Parsing of the original (pre OP_MSG) mongodb wire protocol opcodes.
+// see http://docs.mongodb.org/meta-driver/latest/legacy/mongodb-wire-protocol/#request-opcodes
+
+import (
+	"packetbeat/common"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func parseOpQuery(m *MongodbMessage, data []byte) error {
+	_, off, err := readInt32(data, 0) // flags
+	if err != nil {
+		return err
+	}
+	fullCollectionName, off, err := readCStringAt(data, off)
+	if err != nil {
+		return err
+	}
+	off += 8 // numberToSkip, numberToReturn
+
+	doc, _, err := readDocAsDict(data, off)
+	if err != nil {
+		return err
+	}
+
+	m.method = queryMethodName(doc)
+	if dict, ok := doc.(common.MapStr); ok {
+		doc = redactCommandArgs(m.method, dict)
+		// queryMethodName only recognizes UserCommands, so a configured
+		// command such as createUser is looked for among the keys too.
+		for key := range dict {
+			if redactCommands[key] {
+				doc = redactCommandArgs(key, dict)
+			}
+		}
+	}
+
+	m.event["fullCollectionName"] = fullCollectionName
+	m.event["query"] = doc
+	return nil
+}
+
+func parseOpInsert(m *MongodbMessage, data []byte) error {
+	_, off, err := readInt32(data, 0) // flags
+	if err != nil {
+		return err
+	}
+	fullCollectionName, off, err := readCStringAt(data, off)
+	if err != nil {
+		return err
+	}
+
+	var docs []interface{}
+	for off < len(data) {
+		doc, consumed, err := readDocAsDict(data, off)
+		if err != nil {
+			return err
+		}
+		off = consumed
+		docs = append(docs, doc)
+	}
+
+	m.event["fullCollectionName"] = fullCollectionName
+	m.event["insert"] = docs
+	m.method = "insert"
+	return nil
+}
+
+func parseOpUpdate(m *MongodbMessage, data []byte) error {
+	_, off, err := readInt32(data, 0) // ZERO
+	if err != nil {
+		return err
+	}
+	fullCollectionName, off, err := readCStringAt(data, off)
+	if err != nil {
+		return err
+	}
+	off += 4 // flags
+
+	selector, off, err := readDocAsDict(data, off)
+	if err != nil {
+		return err
+	}
+
+	update, _, err := readDocAsDict(data, off)
+	if err != nil {
+		return err
+	}
+
+	m.event["fullCollectionName"] = fullCollectionName
+	m.event["selector"] = selector
+	m.event["update"] = update
+	m.method = "update"
+	return nil
+}
+
+func parseOpDelete(m *MongodbMessage, data []byte) error {
+	_, off, err := readInt32(data, 0) // ZERO
+	if err != nil {
+		return err
+	}
+	fullCollectionName, off, err := readCStringAt(data, off)
+	if err != nil {
+		return err
+	}
+	off += 4 // flags
+
+	selector, _, err := readDocAsDict(data, off)
+	if err != nil {
+		return err
+	}
+
+	m.event["fullCollectionName"] = fullCollectionName
+	m.event["selector"] = selector
+	m.method = "delete"
+	return nil
+}
+
+func parseOpGetMore(m *MongodbMessage, data []byte) error {
+	_, off, err := readInt32(data, 0) // ZERO
+	if err != nil {
+		return err
+	}
+	fullCollectionName, off, err := readCStringAt(data, off)
+	if err != nil {
+		return err
+	}
+	off += 4 // numberToReturn
+
+	cursorId, _, err := readInt64(data, off)
+	if err != nil {
+		return err
+	}
+
+	m.event["fullCollectionName"] = fullCollectionName
+	m.event["cursorId"] = cursorId
+	m.method = "getMore"
+	return nil
+}
+
+func parseOpKillCursors(m *MongodbMessage, data []byte) error {
+	_, off, err := readInt32(data, 0) // ZERO
+	if err != nil {
+		return err
+	}
+	numberOfCursorIDs, off, err := readInt32(data, off)
+	if err != nil {
+		return err
+	}
+
+	// numberOfCursorIDs comes straight off the wire: a corrupt or hostile
+	// packet can claim far more ids than the packet actually carries (8
+	// bytes each), which would otherwise force a multi-GB allocation via
+	// make()'s capacity argument before a single byte is read.
+	if numberOfCursorIDs < 0 || int64(numberOfCursorIDs)*8 > int64(len(data)-off) {
+		return errTooShort
+	}
+
+	cursorIds := make([]int64, 0, numberOfCursorIDs)
+	for i := int32(0); i < numberOfCursorIDs; i++ {
+		var id int64
+		id, off, err = readInt64(data, off)
+		if err != nil {
+			return err
+		}
+		cursorIds = append(cursorIds, id)
+	}
+
+	m.event["cursorIds"] = cursorIds
+	m.method = "killCursors"
+	return nil
+}
+
+func parseOpReply(m *MongodbMessage, data []byte) error {
+	_, off, err := readInt32(data, 0) // responseFlags
+	if err != nil {
+		return err
+	}
+	cursorId, off, err := readInt64(data, off)
+	if err != nil {
+		return err
+	}
+	off += 4 // startingFrom
+	numberReturned, off, err := readInt32(data, off)
+	if err != nil {
+		return err
+	}
+
+	var docs []interface{}
+	for off < len(data) {
+		doc, consumed, err := readDocAsDict(data, off)
+		if err != nil {
+			return err
+		}
+		off = consumed
+		docs = append(docs, doc)
+	}
+
+	m.event["cursorId"] = cursorId
+	m.event["numberReturned"] = numberReturned
+	m.event["response"] = docs
+
+	if len(docs) == 1 {
+		if doc, ok := docs[0].(common.MapStr); ok {
+			if ok, present := doc["ok"].(float64); present && ok != 1 {
+				if errmsg, present := doc["errmsg"].(string); present {
+					m.error = errmsg
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// readInt64 reads a little-endian int64 at data[offset:offset+8], returning
+// the new offset on success. It errors rather than panicking when data is
+// too short, since every caller feeds it bytes straight off the wire.
+func readInt64(data []byte, offset int) (int64, int, error) {
+	if offset < 0 || offset+8 > len(data) {
+		return 0, offset, errTooShort
+	}
+	return int64(uint64(data[offset]) |
+		uint64(data[offset+1])<<8 |
+		uint64(data[offset+2])<<16 |
+		uint64(data[offset+3])<<24 |
+		uint64(data[offset+4])<<32 |
+		uint64(data[offset+5])<<40 |
+		uint64(data[offset+6])<<48 |
+		uint64(data[offset+7])<<56), offset + 8, nil
+}
+
+// readCStringAt reads a NUL-terminated string starting at data[offset],
+// returning the offset just past the terminator.
+func readCStringAt(data []byte, offset int) (string, int, error) {
+	if offset < 0 || offset > len(data) {
+		return "", offset, errTooShort
+	}
+	s, n := readCString(data[offset:])
+	return s, offset + n, nil
+}
+
+// readDocAsDict reads a single length-prefixed BSON document starting at
+// data[offset] and returns it decoded into plain Go values, together with
+// the offset just past the document.
+func readDocAsDict(data []byte, offset int) (interface{}, int, error) {
+	if offset < 0 || offset > len(data) {
+		return nil, offset, errTooShort
+	}
+
+	raw, consumed, err := readBsonDocRaw(data[offset:])
+	if err != nil {
+		return nil, offset, err
+	}
+
+	var doc bson.M
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return nil, offset, err
+	}
+
+	return bson2dict(doc), offset + consumed, nil
+}
+
+// queryMethodName deduces the mongodb command/operation name carried by an
+// OP_QUERY, which is either a well known user command (the first key of the
+// query document, when it appears in UserCommands) or a plain "find".
+func queryMethodName(doc interface{}) string {
+	dict, ok := doc.(common.MapStr)
+	if !ok {
+		return "find"
+	}
+	for _, cmd := range UserCommands {
+		if _, present := dict[cmd]; present {
+			return cmd
+		}
+	}
+	return "find"
+}
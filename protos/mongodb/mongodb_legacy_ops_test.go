@@ -0,0 +1,69 @@
+package mongodb
+
+import (
+	"bytes"
+	"testing"
+
+	"packetbeat/common"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func TestParseOpQueryWellFormed(t *testing.T) {
+	var buf bytes.Buffer
+	putInt32(&buf, 0) // flags
+	putCString(&buf, "test.coll")
+	putInt32(&buf, 0) // numberToSkip
+	putInt32(&buf, 0) // numberToReturn
+	buf.Write(marshalDoc(t, bson.D{{Name: "count", Value: "coll"}, {Name: "query", Value: bson.M{}}}))
+
+	m := &MongodbMessage{event: common.MapStr{}}
+	if err := parseOpQuery(m, buf.Bytes()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m.method != "count" {
+		t.Errorf("expected method %q, got %q", "count", m.method)
+	}
+	if m.event["fullCollectionName"] != "test.coll" {
+		t.Errorf("expected fullCollectionName %q, got %v", "test.coll", m.event["fullCollectionName"])
+	}
+}
+
+func TestParseOpQueryTruncated(t *testing.T) {
+	// not even enough bytes for the leading flags int32
+	data := []byte{0, 0}
+
+	m := &MongodbMessage{event: common.MapStr{}}
+	if err := parseOpQuery(m, data); err == nil {
+		t.Fatal("expected an error parsing a truncated OP_QUERY, got nil")
+	}
+}
+
+func TestParseOpKillCursorsWellFormed(t *testing.T) {
+	var buf bytes.Buffer
+	putInt32(&buf, 0) // ZERO
+	putInt32(&buf, 2) // numberOfCursorIDs
+	putInt64(&buf, 111)
+	putInt64(&buf, 222)
+
+	m := &MongodbMessage{event: common.MapStr{}}
+	if err := parseOpKillCursors(m, buf.Bytes()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ids, ok := m.event["cursorIds"].([]int64)
+	if !ok || len(ids) != 2 || ids[0] != 111 || ids[1] != 222 {
+		t.Errorf("unexpected cursorIds: %#v", m.event["cursorIds"])
+	}
+}
+
+func TestParseOpKillCursorsHugeCountRejected(t *testing.T) {
+	var buf bytes.Buffer
+	putInt32(&buf, 0)     // ZERO
+	putInt32(&buf, 1<<30) // numberOfCursorIDs: wildly more than the packet carries
+	putInt64(&buf, 111)   // a single id, nowhere near enough for the declared count
+
+	m := &MongodbMessage{event: common.MapStr{}}
+	if err := parseOpKillCursors(m, buf.Bytes()); err == nil {
+		t.Fatal("expected an error for a cursor count that doesn't fit in the packet, got nil")
+	}
+}
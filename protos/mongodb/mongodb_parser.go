@@ -0,0 +1,319 @@
+package mongodb
+
+// Parsing of the mongodb wire protocol.
+// see http://docs.mongodb.org/meta-driver/latest/legacy/mongodb-wire-protocol/
+
+import (
+	"packetbeat/common"
+	"packetbeat/logp"
+
+	"labix.org/v2/mgo/bson"
+)
+
+const mongodbHeaderLength = 16
+
+// OP_MSG flag bits
+// see https://docs.mongodb.com/manual/reference/mongodb-wire-protocol/#op-msg
+const (
+	mongodbMsgFlagChecksumPresent = 1 << 0
+	mongodbMsgFlagMoreToCome      = 1 << 1
+	mongodbMsgFlagExhaustAllowed  = 1 << 16
+)
+
+// mongodbMessageParser feeds on stream.data starting at the beginning of a
+// wire protocol message (the 16 byte standard header) and tries to produce
+// a complete MongodbMessage out of it.
+//
+// ok is false if the data seen so far can't be a valid mongodb message and
+// the stream should be dropped. complete is true once stream.message holds
+// a fully parsed message and stream.data has enough bytes to move on to the
+// next one.
+func mongodbMessageParser(stream *MongodbStream) (ok bool, complete bool) {
+	m := stream.message
+
+	if m.messageLength == 0 {
+		if len(stream.data) < mongodbHeaderLength {
+			return true, false
+		}
+
+		// mongodbHeaderLength bytes are guaranteed available by the check
+		// above, so none of these four reads can fail.
+		messageLength, _, _ := readInt32(stream.data, 0)
+		requestId, _, _ := readInt32(stream.data, 4)
+		responseTo, _, _ := readInt32(stream.data, 8)
+		opCode, _, _ := readInt32(stream.data, 12)
+
+		if messageLength < mongodbHeaderLength {
+			logp.Debug("mongodb", "Invalid message length %d", messageLength)
+			return false, false
+		}
+
+		m.messageLength = int(messageLength)
+		m.requestId = int(requestId)
+		m.responseTo = int(responseTo)
+
+		name, known := OpCodes[int(opCode)]
+		if !known {
+			logp.Debug("mongodb", "Unknown mongodb opcode %d", opCode)
+			return false, false
+		}
+		m.opCode = name
+	}
+
+	if len(stream.data) < m.messageLength {
+		// wait for the rest of the message
+		return true, false
+	}
+
+	body := stream.data[mongodbHeaderLength:m.messageLength]
+
+	m.IsResponse = m.responseTo != 0
+	m.event = common.MapStr{}
+
+	if err := dispatchMessage(m, m.opCode, body); err != nil {
+		logp.Debug("mongodb", "Failed to parse %s message: %v", m.opCode, err)
+		return false, false
+	}
+
+	return true, true
+}
+
+// dispatchMessage parses body according to opCode and fills in m. It is
+// called both for messages read straight off the wire and, recursively,
+// for the payload unwrapped from an OP_COMPRESSED envelope.
+func dispatchMessage(m *MongodbMessage, opCode string, body []byte) error {
+	switch opCode {
+	case "OP_REPLY":
+		return parseOpReply(m, body)
+	case "OP_UPDATE":
+		return parseOpUpdate(m, body)
+	case "OP_INSERT":
+		return parseOpInsert(m, body)
+	case "OP_QUERY":
+		return parseOpQuery(m, body)
+	case "OP_GET_MORE":
+		return parseOpGetMore(m, body)
+	case "OP_DELETE":
+		return parseOpDelete(m, body)
+	case "OP_KILL_CURSORS":
+		return parseOpKillCursors(m, body)
+	case "OP_MSG":
+		return parseOpMsg(m, body)
+	case "OP_MSG_LEGACY":
+		// deprecated, fire-and-forget text message. Nothing structured to
+		// extract, keep it around only so the stream stays in sync.
+		return nil
+	case "OP_COMPRESSED":
+		return parseOpCompressed(m, body)
+	default:
+		logp.Debug("mongodb", "Unhandled mongodb opcode %s", opCode)
+		return nil
+	}
+}
+
+// parseOpMsg decodes an OP_MSG (opcode 2013) body: a flagBits uint32
+// followed by one or more sections, optionally terminated by a CRC-32C
+// checksum when the checksumPresent bit is set.
+func parseOpMsg(m *MongodbMessage, data []byte) error {
+	flagBits, off, err := readInt32(data, 0)
+	if err != nil {
+		return err
+	}
+
+	checksumPresent := flagBits&mongodbMsgFlagChecksumPresent != 0
+	m.moreToCome = flagBits&mongodbMsgFlagMoreToCome != 0
+	_ = flagBits & mongodbMsgFlagExhaustAllowed // exhaustAllowed, not currently surfaced
+
+	end := len(data)
+	if checksumPresent {
+		end -= 4
+	}
+
+	var bodyDoc bson.D
+	haveBody := false
+
+	if off >= end {
+		// an OP_MSG carries at least one section after its flag bits
+		return errTooShort
+	}
+
+	for off < end {
+		if off+1 > len(data) {
+			return errTooShort
+		}
+		kind := data[off]
+		off++
+
+		switch kind {
+		case 0:
+			raw, n, err := readBsonDocRaw(data[off:])
+			if err != nil {
+				return err
+			}
+			off += n
+
+			if err := bson.Unmarshal(raw, &bodyDoc); err != nil {
+				return err
+			}
+			haveBody = true
+
+		case 1:
+			seqSize, _, err := readInt32(data, off)
+			if err != nil {
+				return err
+			}
+			seqEnd := off + int(seqSize)
+			if seqSize < 4 || seqEnd > len(data) {
+				return errTooShort
+			}
+			cur := off + 4
+
+			identifier, n := readCString(data[cur:seqEnd])
+			cur += n
+
+			var docs []interface{}
+			for cur < seqEnd {
+				raw, n, err := readBsonDocRaw(data[cur:seqEnd])
+				if err != nil {
+					return err
+				}
+				cur += n
+
+				var doc bson.M
+				if err := bson.Unmarshal(raw, &doc); err != nil {
+					return err
+				}
+				docs = append(docs, bson2dict(doc))
+			}
+			m.event[identifier] = docs
+
+			off = seqEnd
+
+		default:
+			logp.Debug("mongodb", "Unknown OP_MSG section kind %d", kind)
+			return nil
+		}
+	}
+
+	if !haveBody {
+		return nil
+	}
+
+	dict := bson2dict(bsonDToM(bodyDoc))
+
+	if m.IsResponse {
+		m.event["response"] = dict
+		// A cursor-bearing reply (to find/aggregate/getMore) carries its
+		// cursor under a "cursor" sub-document rather than the legacy
+		// OP_REPLY's top-level cursorId field; pull it out under the same
+		// event key so maybeRegisterCursor doesn't need to know which wire
+		// protocol generation produced this message.
+		if cursor, ok := dict["cursor"].(common.MapStr); ok {
+			if cursorId, ok := cursor["id"].(int64); ok {
+				m.event["cursorId"] = cursorId
+			}
+		}
+		if ok, _ := dict["ok"].(float64); ok != 1 {
+			if errmsg, present := dict["errmsg"].(string); present {
+				m.error = errmsg
+			}
+		}
+		return nil
+	}
+
+	if len(bodyDoc) == 0 {
+		return nil
+	}
+
+	cmdName := bodyDoc[0].Name
+	m.method = cmdName
+
+	dbName, _ := dict["$db"].(string)
+	setFullCollectionName := func(collection string) {
+		if dbName != "" {
+			m.event["fullCollectionName"] = dbName + "." + collection
+		} else {
+			m.event["fullCollectionName"] = collection
+		}
+	}
+
+	switch value := bodyDoc[0].Value.(type) {
+	case string:
+		setFullCollectionName(value)
+	case int64:
+		// getMore's command value is the cursorId being paged through, not
+		// a collection name; the collection instead lives under its own
+		// "collection" key.
+		m.event["cursorId"] = value
+		if collection, ok := dict["collection"].(string); ok {
+			setFullCollectionName(collection)
+		}
+	default:
+		// a database-level command (e.g. ping) names no collection
+		if dbName != "" {
+			m.event["fullCollectionName"] = dbName
+		}
+	}
+
+	if cmdName == "killCursors" {
+		if ids, ok := dict["cursors"].([]interface{}); ok {
+			cursorIds := make([]int64, 0, len(ids))
+			for _, id := range ids {
+				if cursorId, ok := id.(int64); ok {
+					cursorIds = append(cursorIds, cursorId)
+				}
+			}
+			m.event["cursorIds"] = cursorIds
+		}
+	}
+
+	m.event["query"] = redactCommandArgs(cmdName, dict)
+
+	return nil
+}
+
+// bsonDToM converts an ordered bson.D to a bson.M, used once the original
+// field order has already been consumed (e.g. to pick the command name).
+func bsonDToM(d bson.D) bson.M {
+	m := bson.M{}
+	for _, elem := range d {
+		m[elem.Name] = elem.Value
+	}
+	return m
+}
+
+// readBsonDocRaw reads a single length-prefixed BSON document starting at
+// data[0] and returns its raw bytes (including the length prefix and the
+// trailing NUL) together with the number of bytes consumed.
+func readBsonDocRaw(data []byte) (raw []byte, consumed int, err error) {
+	length, _, err := readInt32(data, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	if int(length) < 5 || int(length) > len(data) {
+		return nil, 0, errTooShort
+	}
+	return data[:length], int(length), nil
+}
+
+// readInt32 reads a little-endian int32 at data[offset:offset+4], returning
+// the new offset on success. It errors rather than panicking when data is
+// too short, since every caller feeds it bytes straight off the wire.
+func readInt32(data []byte, offset int) (int32, int, error) {
+	if offset < 0 || offset+4 > len(data) {
+		return 0, offset, errTooShort
+	}
+	return int32(uint32(data[offset]) |
+		uint32(data[offset+1])<<8 |
+		uint32(data[offset+2])<<16 |
+		uint32(data[offset+3])<<24), offset + 4, nil
+}
+
+func readCString(data []byte) (string, int) {
+	for i, b := range data {
+		if b == 0 {
+			return string(data[:i]), i + 1
+		}
+	}
+	return string(data), len(data)
+}
@@ -0,0 +1,119 @@
+package mongodb
+
+import (
+	"bytes"
+	"testing"
+
+	"packetbeat/common"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func TestParseOpMsgWellFormed(t *testing.T) {
+	var buf bytes.Buffer
+	putInt32(&buf, 0) // flagBits
+	buf.WriteByte(0)  // section kind 0: body
+	buf.Write(marshalDoc(t, bson.D{{Name: "ping", Value: 1}, {Name: "$db", Value: "admin"}}))
+
+	m := &MongodbMessage{event: common.MapStr{}}
+	if err := parseOpMsg(m, buf.Bytes()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m.method != "ping" {
+		t.Errorf("expected method %q, got %q", "ping", m.method)
+	}
+	if m.event["fullCollectionName"] != "admin" {
+		t.Errorf("expected fullCollectionName %q, got %v", "admin", m.event["fullCollectionName"])
+	}
+}
+
+func TestParseOpMsgTruncatedAfterFlags(t *testing.T) {
+	// flagBits present, but the message ends right before the section kind byte
+	var buf bytes.Buffer
+	putInt32(&buf, 0)
+
+	m := &MongodbMessage{event: common.MapStr{}}
+	if err := parseOpMsg(m, buf.Bytes()); err == nil {
+		t.Fatal("expected an error parsing an OP_MSG with no sections, got nil")
+	}
+}
+
+func TestParseOpMsgTruncatedSequenceSection(t *testing.T) {
+	var buf bytes.Buffer
+	putInt32(&buf, 0)    // flagBits
+	buf.WriteByte(1)     // section kind 1: document sequence
+	putInt32(&buf, 1000) // seqSize claims far more than actually follows
+	putCString(&buf, "documents")
+
+	m := &MongodbMessage{event: common.MapStr{}}
+	if err := parseOpMsg(m, buf.Bytes()); err == nil {
+		t.Fatal("expected an error for a document sequence section overrunning the message, got nil")
+	}
+}
+
+func TestParseOpMsgGetMoreExtractsCursorId(t *testing.T) {
+	var buf bytes.Buffer
+	putInt32(&buf, 0) // flagBits
+	buf.WriteByte(0)  // section kind 0: body
+	buf.Write(marshalDoc(t, bson.D{
+		{Name: "getMore", Value: int64(123456)},
+		{Name: "collection", Value: "coll"},
+		{Name: "$db", Value: "test"},
+	}))
+
+	m := &MongodbMessage{event: common.MapStr{}}
+	if err := parseOpMsg(m, buf.Bytes()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m.method != "getMore" {
+		t.Errorf("expected method %q, got %q", "getMore", m.method)
+	}
+	if cursorId, ok := m.event["cursorId"].(int64); !ok || cursorId != 123456 {
+		t.Errorf("expected cursorId 123456, got %#v", m.event["cursorId"])
+	}
+	if m.event["fullCollectionName"] != "test.coll" {
+		t.Errorf("expected fullCollectionName %q, got %v", "test.coll", m.event["fullCollectionName"])
+	}
+}
+
+func TestParseOpMsgKillCursorsExtractsCursorIds(t *testing.T) {
+	var buf bytes.Buffer
+	putInt32(&buf, 0) // flagBits
+	buf.WriteByte(0)  // section kind 0: body
+	buf.Write(marshalDoc(t, bson.D{
+		{Name: "killCursors", Value: "coll"},
+		{Name: "cursors", Value: []interface{}{int64(111), int64(222)}},
+		{Name: "$db", Value: "test"},
+	}))
+
+	m := &MongodbMessage{event: common.MapStr{}}
+	if err := parseOpMsg(m, buf.Bytes()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ids, ok := m.event["cursorIds"].([]int64)
+	if !ok || len(ids) != 2 || ids[0] != 111 || ids[1] != 222 {
+		t.Errorf("unexpected cursorIds: %#v", m.event["cursorIds"])
+	}
+}
+
+func TestParseOpMsgResponseExtractsCursorId(t *testing.T) {
+	var buf bytes.Buffer
+	putInt32(&buf, 0) // flagBits
+	buf.WriteByte(0)  // section kind 0: body
+	buf.Write(marshalDoc(t, bson.D{
+		{Name: "cursor", Value: bson.D{
+			{Name: "id", Value: int64(777)},
+			{Name: "ns", Value: "test.coll"},
+			{Name: "firstBatch", Value: []interface{}{}},
+		}},
+		{Name: "ok", Value: float64(1)},
+	}))
+
+	m := &MongodbMessage{event: common.MapStr{}, IsResponse: true}
+	if err := parseOpMsg(m, buf.Bytes()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cursorId, ok := m.event["cursorId"].(int64); !ok || cursorId != 777 {
+		t.Errorf("expected cursorId 777, got %#v", m.event["cursorId"])
+	}
+}
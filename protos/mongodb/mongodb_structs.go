@@ -16,6 +16,12 @@ type MongodbMessage struct {
 	IsResponse      bool
 	ExpectsResponse bool
 
+	// set from the OP_MSG moreToCome flag: the sender isn't waiting for a
+	// reply to this message (request) or will send further responses for
+	// the same requestId before the exchange is done (response, e.g.
+	// exhaust cursors)
+	moreToCome bool
+
 	// Standard message header fields from mongodb wire protocol
 	// see http://docs.mongodb.org/meta-driver/latest/legacy/mongodb-wire-protocol/#standard-message-header
 	messageLength int
@@ -63,6 +69,7 @@ type mongodbPrivateData struct {
 type MongodbTransaction struct {
 	Type         string
 	tuple        common.TcpTuple
+	requestId    int // matched against the responseTo of the reply that completes this transaction
 	cmdline      *common.CmdlineTuple
 	Src          common.Endpoint
 	Dst          common.Endpoint
@@ -86,11 +93,40 @@ const (
 	TransactionTimeout   = 10 * 1e9
 )
 
+// cursorKey identifies a server-side cursor opened by a query (legacy
+// OP_QUERY or an OP_MSG find/aggregate) on a given connection. Cursor IDs are only meaningful within the connection
+// that opened them, so the TCP tuple is part of the key.
+type cursorKey struct {
+	tuple    common.HashableTcpTuple
+	cursorId int64
+}
+
+// cursorInfo is kept in Mongodb.cursorRegistry for the lifetime of a
+// server-side cursor, from the query reply that opened it to the
+// killCursors request (or cursor_ttl expiry) that closes it.
+type cursorInfo struct {
+	collection string
+	query      common.MapStr
+	start      time.Time
+	roundTrips int
+	timer      *time.Timer
+}
+
+const CursorTTLDefault = 5 * time.Minute
+
+// MongodbRedactConfig is protocols.mongodb.redact: field_names are BSON keys
+// whose value is always replaced, commands are command names whose whole
+// argument document is dropped.
+type MongodbRedactConfig struct {
+	Field_names []string
+	Commands    []string
+}
+
 // List of valid mongodb wire protocol operation codes
 // see http://docs.mongodb.org/meta-driver/latest/legacy/mongodb-wire-protocol/#request-opcodes
 var OpCodes = map[int]string{
 	1:    "OP_REPLY",
-	1000: "OP_MSG",
+	1000: "OP_MSG_LEGACY", // deprecated since MongoDB 5.1, rarely seen on the wire
 	2001: "OP_UPDATE",
 	2002: "OP_INSERT",
 	2003: "RESERVED",
@@ -98,6 +134,8 @@ var OpCodes = map[int]string{
 	2005: "OP_GET_MORE",
 	2006: "OP_DELETE",
 	2007: "OP_KILL_CURSORS",
+	2012: "OP_COMPRESSED",
+	2013: "OP_MSG", // MongoDB 3.6+ wire protocol, replaces the legacy opcodes above
 }
 
 // List of mongodb user commands (send throuwh a query of the legacy protocol)
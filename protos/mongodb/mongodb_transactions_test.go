@@ -0,0 +1,112 @@
+package mongodb
+
+import (
+	"testing"
+	"time"
+
+	"packetbeat/common"
+)
+
+func TestDequeueTransactionMatchesByRequestIdNotQueuePosition(t *testing.T) {
+	mongodb, _ := newTestMongodb(t)
+	tuple := testTcpTuple(10)
+
+	first := &MongodbTransaction{tuple: *tuple, requestId: 1}
+	second := &MongodbTransaction{tuple: *tuple, requestId: 2}
+	mongodb.enqueueTransaction(first)
+	mongodb.enqueueTransaction(second)
+
+	got := mongodb.dequeueTransaction(*tuple, 2)
+	if got != second {
+		t.Fatalf("expected to dequeue the transaction matching responseTo, got %#v", got)
+	}
+
+	remaining := mongodb.transactionsMap[tuple.Hashable()]
+	if len(remaining) != 1 || remaining[0] != first {
+		t.Errorf("expected only the unmatched transaction to remain queued, got %#v", remaining)
+	}
+}
+
+func TestDequeueTransactionReturnsNilWhenNoMatch(t *testing.T) {
+	mongodb, _ := newTestMongodb(t)
+	tuple := testTcpTuple(11)
+
+	mongodb.enqueueTransaction(&MongodbTransaction{tuple: *tuple, requestId: 1})
+
+	if got := mongodb.dequeueTransaction(*tuple, 999); got != nil {
+		t.Errorf("expected no match, got %#v", got)
+	}
+}
+
+func TestReceivedMongodbRequestResponseRoundTrip(t *testing.T) {
+	mongodb, results := newTestMongodb(t)
+	tuple := testTcpTuple(12)
+
+	request := &MongodbMessage{
+		TcpTuple:     *tuple,
+		CmdlineTuple: testCmdlineTuple(),
+		Ts:           time.Unix(1, 0),
+		requestId:    7,
+		method:       "find",
+		event:        common.MapStr{"fullCollectionName": "test.coll"},
+	}
+	mongodb.receivedMongodbRequest(request)
+
+	queue := mongodb.transactionsMap[tuple.Hashable()]
+	if len(queue) != 1 {
+		t.Fatalf("expected one outstanding transaction, got %d", len(queue))
+	}
+	queue[0].timer.Stop()
+
+	response := &MongodbMessage{
+		TcpTuple:   *tuple,
+		Ts:         time.Unix(1, 500000000),
+		responseTo: 7,
+		event:      common.MapStr{"response": common.MapStr{"ok": float64(1)}},
+	}
+	mongodb.receivedMongodbResponse(response)
+
+	select {
+	case event := <-results:
+		if event["method"] != "find" {
+			t.Errorf("expected method %q, got %v", "find", event["method"])
+		}
+	default:
+		t.Fatal("expected a transaction to be published")
+	}
+
+	if len(mongodb.transactionsMap) != 0 {
+		t.Errorf("expected the transaction queue to be empty after the response, got %#v", mongodb.transactionsMap)
+	}
+}
+
+func TestReceivedMongodbResponseMoreToComeReEnqueues(t *testing.T) {
+	mongodb, results := newTestMongodb(t)
+	tuple := testTcpTuple(13)
+
+	trans := &MongodbTransaction{
+		Type:      "mongodb",
+		tuple:     *tuple,
+		requestId: 3,
+		event:     common.MapStr{},
+		ts:        time.Unix(1, 0),
+	}
+	mongodb.enqueueTransaction(trans)
+
+	response := &MongodbMessage{
+		TcpTuple:   *tuple,
+		Ts:         time.Unix(1, 100000000),
+		responseTo: 3,
+		moreToCome: true,
+		event:      common.MapStr{},
+	}
+	mongodb.receivedMongodbResponse(response)
+
+	<-results // drain the publish that happens on every response, including exhaust ones
+
+	queue := mongodb.transactionsMap[tuple.Hashable()]
+	if len(queue) != 1 || queue[0] != trans {
+		t.Fatalf("expected the transaction to be re-enqueued for further exhaust responses, got %#v", queue)
+	}
+	queue[0].timer.Stop()
+}
@@ -0,0 +1,61 @@
+package mongodb
+
+// Shared helpers for building raw wire protocol bytes in the parser tests
+// below, so each _test.go file can focus on the opcode it exercises.
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"packetbeat/common"
+
+	"labix.org/v2/mgo/bson"
+)
+
+func putInt32(buf *bytes.Buffer, v int32) {
+	buf.WriteByte(byte(v))
+	buf.WriteByte(byte(v >> 8))
+	buf.WriteByte(byte(v >> 16))
+	buf.WriteByte(byte(v >> 24))
+}
+
+func putInt64(buf *bytes.Buffer, v int64) {
+	buf.WriteByte(byte(v))
+	buf.WriteByte(byte(v >> 8))
+	buf.WriteByte(byte(v >> 16))
+	buf.WriteByte(byte(v >> 24))
+	buf.WriteByte(byte(v >> 32))
+	buf.WriteByte(byte(v >> 40))
+	buf.WriteByte(byte(v >> 48))
+	buf.WriteByte(byte(v >> 56))
+}
+
+func putCString(buf *bytes.Buffer, s string) {
+	buf.WriteString(s)
+	buf.WriteByte(0)
+}
+
+func marshalDoc(t *testing.T, doc interface{}) []byte {
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatalf("failed to marshal test document: %v", err)
+	}
+	return raw
+}
+
+// testTcpTuple returns a distinct TcpTuple for each call, so tests that
+// track per-connection state (transaction queues, cursor registries) don't
+// collide with each other.
+func testTcpTuple(srcPort uint16) *common.TcpTuple {
+	return &common.TcpTuple{
+		Src_ip:   net.ParseIP("10.0.0.1"),
+		Dst_ip:   net.ParseIP("10.0.0.2"),
+		Src_port: srcPort,
+		Dst_port: 27017,
+	}
+}
+
+func testCmdlineTuple() *common.CmdlineTuple {
+	return &common.CmdlineTuple{Src: []byte("client"), Dst: []byte("mongod")}
+}